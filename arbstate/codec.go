@@ -0,0 +1,157 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+package arbstate
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// SegmentCodec compresses and decompresses the RLP-encoded segments that
+// follow a sequencer message's header. Implementations are registered in
+// codecsByID under the single-byte tag stored in the header, so that the
+// inbox reader can be extended with new codecs without changing the
+// header format again.
+type SegmentCodec interface {
+	NewReader(r io.Reader) io.Reader
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+// DictionaryCodec is implemented by codecs that can be seeded with a
+// preset dictionary, so that tiny sequencer batches don't have to pay for
+// a compressor to warm up its window before it starts saving bytes.
+type DictionaryCodec interface {
+	SegmentCodec
+	NewReaderWithDictionary(r io.Reader, dict []byte) io.Reader
+	NewWriterWithDictionary(w io.Writer, dict []byte) io.WriteCloser
+}
+
+// Codec ids stored in an extended sequencer message header (see
+// afterDelayedMessagesExtendedFlag in inbox.go). A legacy 40-byte header
+// carries no codec id at all and is always brotli; 0 is reserved for
+// brotli here too, so that a batch which opts into the extended header
+// without changing codec decodes the same way.
+const (
+	BrotliCodecID uint8 = iota
+	ZstdCodecID
+	SnappyCodecID
+	RawCodecID
+)
+
+// knownCodecIDs fixes an iteration order over codecsByID so that codec
+// selection (see sequencerMessage.EncodeSmallest) is deterministic.
+var knownCodecIDs = []uint8{BrotliCodecID, ZstdCodecID, SnappyCodecID, RawCodecID}
+
+var codecsByID = map[uint8]SegmentCodec{
+	BrotliCodecID: brotliCodec{},
+	ZstdCodecID:   zstdCodec{},
+	SnappyCodecID: snappyCodec{},
+	RawCodecID:    rawCodec{},
+}
+
+// UnknownCodecError is returned when a sequencer message names a codec id
+// that isn't registered, so callers can tell "batch from a newer node we
+// don't understand yet" apart from a batch that's simply malformed.
+type UnknownCodecError struct {
+	CodecID uint8
+}
+
+func (e *UnknownCodecError) Error() string {
+	return fmt.Sprintf("unknown segment codec id %v", e.CodecID)
+}
+
+func codecByID(id uint8) (SegmentCodec, error) {
+	codec, ok := codecsByID[id]
+	if !ok {
+		return nil, &UnknownCodecError{CodecID: id}
+	}
+	return codec, nil
+}
+
+// errReader/errWriter let a codec whose constructor can fail (zstd's, in
+// particular) still satisfy the error-free SegmentCodec signature: the
+// error surfaces on the first Read or Write instead.
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+type errWriter struct{ err error }
+
+func (e errWriter) Write([]byte) (int, error) { return 0, e.err }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// brotliCodec only implements SegmentCodec, not DictionaryCodec: the
+// andybalholm/brotli package this wraps has no preset-dictionary support
+// (its WriterOptions/Reader expose no such hook), so resolveCodecAndDictionary
+// rejects any batch naming a dictionary id alongside BrotliCodecID rather
+// than silently ignoring it: "codec does not support dictionaries" when a
+// DictionaryProvider is configured, the missing-provider error otherwise.
+type brotliCodec struct{}
+
+func (brotliCodec) NewReader(r io.Reader) io.Reader      { return brotli.NewReader(r) }
+func (brotliCodec) NewWriter(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+
+type zstdCodec struct{}
+
+// NewReader sets WithDecoderConcurrency(1): zstd's default decoder spins up
+// a background goroutine and channel per call for streaming input read
+// from anything other than a *bytes.Buffer (the bytes.Reader payload slice
+// passed in here included), which only a later Close or a GC finalizer
+// releases. SegmentCodec.NewReader returns a plain io.Reader with no Close,
+// so nothing downstream could ever release it; decoding synchronously on
+// the calling goroutine avoids spawning it at all.
+func (zstdCodec) NewReader(r io.Reader) io.Reader {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return errReader{err}
+	}
+	return decoder.IOReadCloser()
+}
+
+func (zstdCodec) NewWriter(w io.Writer) io.WriteCloser {
+	encoder, err := zstd.NewWriter(w)
+	if err != nil {
+		return nopWriteCloser{errWriter{err}}
+	}
+	return encoder
+}
+
+// NewReaderWithDictionary sets WithDecoderConcurrency(1) for the same
+// reason as NewReader: avoid spawning a decode goroutine that nothing
+// downstream can close.
+func (zstdCodec) NewReaderWithDictionary(r io.Reader, dict []byte) io.Reader {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderDicts(dict), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return errReader{err}
+	}
+	return decoder.IOReadCloser()
+}
+
+func (zstdCodec) NewWriterWithDictionary(w io.Writer, dict []byte) io.WriteCloser {
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderDict(dict))
+	if err != nil {
+		return nopWriteCloser{errWriter{err}}
+	}
+	return encoder
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) NewReader(r io.Reader) io.Reader      { return s2.NewReader(r) }
+func (snappyCodec) NewWriter(w io.Writer) io.WriteCloser { return s2.NewWriter(w) }
+
+// rawCodec stores segments uncompressed, which beats the overhead of a
+// compression frame for the smallest batches.
+type rawCodec struct{}
+
+func (rawCodec) NewReader(r io.Reader) io.Reader      { return r }
+func (rawCodec) NewWriter(w io.Writer) io.WriteCloser { return nopWriteCloser{w} }
@@ -0,0 +1,69 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+package arbstate
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// TestCodecRoundTrip round-trips a multi-segment message through every
+// registered codec and confirms the decoded bytes match what was written.
+func TestCodecRoundTrip(t *testing.T) {
+	segments := [][]byte{
+		{segmentKindL2Message, 0x01, 0x02, 0x03},
+		{segmentKindAdvanceTimestamp, 0x05},
+		{segmentKindL2Message, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09},
+	}
+	payload := bytes.Join(segments, nil)
+
+	for _, codecID := range knownCodecIDs {
+		codec, err := codecByID(codecID)
+		if err != nil {
+			t.Fatalf("codecByID(%v): %v", codecID, err)
+		}
+
+		var buf bytes.Buffer
+		writer := codec.NewWriter(&buf)
+		if _, err := writer.Write(payload); err != nil {
+			t.Fatalf("codec %v: Write: %v", codecID, err)
+		}
+		if flusher, ok := writer.(interface{ Flush() error }); ok {
+			if err := flusher.Flush(); err != nil {
+				t.Fatalf("codec %v: Flush: %v", codecID, err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("codec %v: Close: %v", codecID, err)
+		}
+
+		decoded, err := ioutil.ReadAll(codec.NewReader(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatalf("codec %v: ReadAll: %v", codecID, err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatalf("codec %v: round trip mismatch: got %x, want %x", codecID, decoded, payload)
+		}
+	}
+}
+
+// TestCodecByIDRejectsUnknownIDs confirms a codec id above the registered
+// range comes back as an *UnknownCodecError rather than a nil codec or a
+// panic.
+func TestCodecByIDRejectsUnknownIDs(t *testing.T) {
+	_, err := codecByID(4)
+	if err == nil {
+		t.Fatal("codecByID(4): expected an error, got nil")
+	}
+	var unknown *UnknownCodecError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("codecByID(4): expected *UnknownCodecError, got %T: %v", err, err)
+	}
+	if unknown.CodecID != 4 {
+		t.Fatalf("unknown.CodecID = %v, want 4", unknown.CodecID)
+	}
+}
@@ -0,0 +1,41 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+package arbstate
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// DictionaryProvider resolves the dictionary id carried in a sequencer
+// message's header to the raw preset-dictionary bytes it names. Batches
+// that carry a dictionary id of 0 need no provider at all; everything else
+// depends on the caller having the matching dictionary on hand, whether
+// that's loaded from disk, pulled from an L1 contract, or pinned in memory.
+type DictionaryProvider interface {
+	GetDictionary(id uint32) ([]byte, error)
+}
+
+// StaticDictionaryProvider serves dictionaries pinned in memory ahead of
+// time, e.g. loaded from disk at startup.
+type StaticDictionaryProvider map[uint32][]byte
+
+func (p StaticDictionaryProvider) GetDictionary(id uint32) ([]byte, error) {
+	dict, ok := p[id]
+	if !ok {
+		return nil, fmt.Errorf("no dictionary registered for id %v", id)
+	}
+	return dict, nil
+}
+
+// DictionaryID derives the id a dictionary is referenced by from its
+// keccak256, so that replaying a sequencer message from L1 data alone is
+// enough to look the dictionary up again deterministically.
+func DictionaryID(dict []byte) uint32 {
+	hash := crypto.Keccak256(dict)
+	return binary.BigEndian.Uint32(hash[:4])
+}
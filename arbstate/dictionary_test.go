@@ -0,0 +1,201 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+package arbstate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// buildTestZstdDictionary trains a real zstd dictionary from sample via the
+// zstd CLI's --train mode, split into several sample files the way the
+// trainer expects a corpus. zstd.WithEncoderDict/WithDecoderDicts require
+// a dictionary in zstd's own trained format (magic number plus entropy
+// tables), which klauspost/compress doesn't build itself; skips the test
+// if the zstd binary isn't on PATH.
+func buildTestZstdDictionary(t *testing.T, sample []byte) []byte {
+	t.Helper()
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd CLI not found on PATH, skipping dictionary-training test")
+	}
+
+	dir := t.TempDir()
+	const chunks = 8
+	chunkLen := len(sample) / chunks
+	if chunkLen == 0 {
+		chunkLen = len(sample)
+	}
+	var samplePaths []string
+	for i := 0; i*chunkLen < len(sample); i++ {
+		end := (i + 1) * chunkLen
+		if end > len(sample) {
+			end = len(sample)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("sample-%d", i))
+		if err := ioutil.WriteFile(path, sample[i*chunkLen:end], 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		samplePaths = append(samplePaths, path)
+	}
+
+	dictPath := filepath.Join(dir, "dictionary")
+	args := append([]string{"--train"}, samplePaths...)
+	args = append(args, "-o", dictPath, "--maxdict=4096")
+	if out, err := exec.Command("zstd", args...).CombinedOutput(); err != nil {
+		t.Fatalf("zstd --train: %v: %s", err, out)
+	}
+
+	dict, err := ioutil.ReadFile(dictPath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return dict
+}
+
+// TestZstdDictionaryCompressesSmaller confirms a small, repetitive payload
+// compresses significantly smaller when seeded with a dictionary built from
+// similar content than with no dictionary at all.
+func TestZstdDictionaryCompressesSmaller(t *testing.T) {
+	sample := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog; "), 64)
+	payload := sample[:256]
+
+	dict := buildTestZstdDictionary(t, sample)
+
+	var withoutDict bytes.Buffer
+	w := zstdCodec{}.NewWriter(&withoutDict)
+	if _, err := w.Write(payload); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var withDict bytes.Buffer
+	wd := zstdCodec{}.NewWriterWithDictionary(&withDict, dict)
+	if _, err := wd.Write(payload); err != nil {
+		t.Fatalf("Write with dictionary: %v", err)
+	}
+	if err := wd.Close(); err != nil {
+		t.Fatalf("Close with dictionary: %v", err)
+	}
+
+	if withDict.Len() >= withoutDict.Len() {
+		t.Fatalf("dictionary-seeded compression (%v bytes) not smaller than unseeded (%v bytes)", withDict.Len(), withoutDict.Len())
+	}
+
+	decoded, err := ioutil.ReadAll(zstdCodec{}.NewReaderWithDictionary(bytes.NewReader(withDict.Bytes()), dict))
+	if err != nil {
+		t.Fatalf("ReadAll with matching dictionary: %v", err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Fatalf("decoded payload mismatch with matching dictionary")
+	}
+}
+
+// TestZstdMalformedDictionaryIsCleanError confirms a dictionary that isn't
+// in zstd's dictionary format surfaces as a plain error on first use rather
+// than panicking, for both directions.
+func TestZstdMalformedDictionaryIsCleanError(t *testing.T) {
+	garbage := []byte("not a zstd dictionary")
+
+	_, err := ioutil.ReadAll(zstdCodec{}.NewReaderWithDictionary(bytes.NewReader(nil), garbage))
+	if err == nil {
+		t.Fatal("expected an error decoding with a malformed dictionary, got nil")
+	}
+
+	w := zstdCodec{}.NewWriterWithDictionary(ioutil.Discard, garbage)
+	if _, err := w.Write([]byte("hello")); err == nil {
+		t.Fatal("expected an error encoding with a malformed dictionary, got nil")
+	}
+}
+
+// TestResolveCodecAndDictionaryUnknownID confirms a sequencer message naming
+// a dictionary id the provider doesn't recognize fails cleanly instead of
+// panicking.
+func TestResolveCodecAndDictionaryUnknownID(t *testing.T) {
+	_, _, err := resolveCodecAndDictionary(ZstdCodecID, 42, StaticDictionaryProvider{})
+	if err == nil {
+		t.Fatal("expected an error for an unresolvable dictionary id, got nil")
+	}
+}
+
+// TestResolveCodecAndDictionaryUnsupportedCodec confirms naming a dictionary
+// alongside a codec that doesn't support one (brotli) fails cleanly.
+func TestResolveCodecAndDictionaryUnsupportedCodec(t *testing.T) {
+	// resolveCodecAndDictionary rejects naming a dictionary alongside
+	// brotli before it ever looks at the dictionary's contents, so an
+	// arbitrary non-empty byte slice is enough here; it need not be a
+	// valid zstd dictionary.
+	dict := bytes.Repeat([]byte("x"), 16)
+	provider := StaticDictionaryProvider{7: dict}
+	_, _, err := resolveCodecAndDictionary(BrotliCodecID, 7, provider)
+	if err == nil {
+		t.Fatal("expected an error naming a dictionary alongside brotli, got nil")
+	}
+	var unknown *UnknownCodecError
+	if errors.As(err, &unknown) {
+		t.Fatalf("expected a dictionary-unsupported error, got UnknownCodecError: %v", err)
+	}
+}
+
+// TestEncodeWithDictionaryMalformedDictReturnsError confirms that a dict
+// which isn't in zstd's dictionary format makes EncodeWithDictionary return
+// an error rather than panic: dict may come from outside this process (a
+// corrupt file on disk, a bad L1 contract read), so a malformed one must
+// not be able to crash the encoding node.
+func TestEncodeWithDictionaryMalformedDictReturnsError(t *testing.T) {
+	msg := sequencerMessage{
+		maxTimestamp: 1000,
+		maxL1Block:   1000,
+		segments:     testSegments(),
+	}
+	_, err := msg.EncodeWithDictionary(ZstdCodecID, 1, []byte("not a zstd dictionary"))
+	if err == nil {
+		t.Fatal("expected an error encoding with a malformed dictionary, got nil")
+	}
+}
+
+// TestEncodeWithDictionaryRoundTrips confirms EncodeWithDictionary, the
+// dictionary feature's actual write path, round-trips through
+// parseSequencerMessage with a DictionaryProvider that resolves the id it
+// carries. TestZstdDictionaryCompressesSmaller exercises the codec's
+// reader/writer directly and wouldn't have caught a bug specific to this
+// path (such as compress returning the buffer before the writer's Close had
+// finished writing zstd's frame terminator).
+func TestEncodeWithDictionaryRoundTrips(t *testing.T) {
+	sample := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog; "), 64)
+	dict := buildTestZstdDictionary(t, sample)
+	dictionaryID := DictionaryID(dict)
+
+	msg := sequencerMessage{
+		minTimestamp:         10,
+		maxTimestamp:         20,
+		minL1Block:           30,
+		maxL1Block:           40,
+		afterDelayedMessages: 50,
+		segments:             testSegments(),
+	}
+	data, err := msg.EncodeWithDictionary(ZstdCodecID, dictionaryID, dict)
+	if err != nil {
+		t.Fatalf("EncodeWithDictionary: %v", err)
+	}
+
+	parsed, err := parseSequencerMessage(data, StaticDictionaryProvider{dictionaryID: dict})
+	if err != nil {
+		t.Fatalf("parseSequencerMessage: %v", err)
+	}
+	if !reflect.DeepEqual(parsed.segments, msg.segments) {
+		t.Fatalf("segments = %v, want %v", parsed.segments, msg.segments)
+	}
+	if parsed.afterDelayedMessages != msg.afterDelayedMessages {
+		t.Fatalf("afterDelayedMessages = %v, want %v", parsed.afterDelayedMessages, msg.afterDelayedMessages)
+	}
+}
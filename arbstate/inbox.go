@@ -12,9 +12,9 @@ import (
 	"io"
 	"math/big"
 
-	"github.com/andybalholm/brotli"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/offchainlabs/arbstate/arbos"
 )
@@ -55,53 +55,241 @@ type sequencerMessage struct {
 
 const maxDecompressedLen int64 = 1024 * 1024 * 16 // 16 MiB
 
-func parseSequencerMessage(data []byte) *sequencerMessage {
-	if len(data) < 40 {
-		panic("sequencer message missing L1 header")
+// legacySequencerMessageHeaderLen is the header size used by every batch
+// posted before codec dispatch existed: five big-endian uint64 fields, with
+// no codec tag, decoded as a single brotli stream starting immediately
+// after the header.
+const legacySequencerMessageHeaderLen = 40
+
+// sequencerMessageHeaderLen is the size, in bytes, of the extended L1
+// header used once a batch opts into pluggable codecs: the same five
+// big-endian uint64 fields, a one-byte codec tag naming how the remainder
+// of the message is compressed, and a 4-byte dictionary id (0 meaning "no
+// preset dictionary").
+const sequencerMessageHeaderLen = 45
+
+// afterDelayedMessagesExtendedFlag is the top bit of the afterDelayedMessages
+// header field, repurposed as the legacy/extended header discriminator: no
+// batch posted before codec dispatch existed ever set it, since no batch is
+// anywhere close to 2^63 delayed messages, so it can tell a legacy 40-byte
+// header apart from an extended one without a length check, which would
+// misread the first byte of an old brotli stream as a codec id.
+const afterDelayedMessagesExtendedFlag = uint64(1) << 63
+
+// MalformedBatchError wraps a sequencer message that failed to parse,
+// recording the inbox position it was found at and the raw bytes so a
+// caller can log or replay the offending batch.
+type MalformedBatchError struct {
+	Position uint64
+	Data     []byte
+	Err      error
+
+	// fallback, if non-nil, is the best-effort sequencerMessage recovered
+	// from whatever header fields were readable before the failure. It
+	// backs the "treat the batch as empty" policy in inboxMultiplexer.
+	fallback *sequencerMessage
+}
+
+func (e *MalformedBatchError) Error() string {
+	return fmt.Sprintf("malformed sequencer batch at position %v: %s", e.Position, e.Err.Error())
+}
+
+func (e *MalformedBatchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoSequencerMessage is returned by Peek when the backend has no
+// sequencer message at all at the current position, i.e. the reader has
+// caught up to the tip of the inbox rather than found something malformed
+// there. Callers should treat it as "nothing to do yet" and retry once more
+// L1 data has been posted, not as a parse failure to recover from.
+var ErrNoSequencerMessage = errors.New("no sequencer message at this position")
+
+func parseSequencerMessage(data []byte, dictionaries DictionaryProvider) (*sequencerMessage, error) {
+	header, codec, dict, payload, err := parseSequencerMessageHeader(data, dictionaries)
+	if err != nil {
+		return nil, &MalformedBatchError{Data: data, Err: err, fallback: header}
+	}
+	var reader io.Reader
+	if len(dict) == 0 {
+		reader = codec.NewReader(bytes.NewReader(payload))
+	} else {
+		reader = codec.(DictionaryCodec).NewReaderWithDictionary(bytes.NewReader(payload), dict)
 	}
-	minTimestamp := binary.BigEndian.Uint64(data[:8])
-	maxTimestamp := binary.BigEndian.Uint64(data[8:16])
-	minL1Block := binary.BigEndian.Uint64(data[16:24])
-	maxL1Block := binary.BigEndian.Uint64(data[24:32])
-	afterDelayedMessages := binary.BigEndian.Uint64(data[32:40])
-	reader := io.LimitReader(brotli.NewReader(bytes.NewReader(data[40:])), maxDecompressedLen)
+	reader = io.LimitReader(reader, maxDecompressedLen)
 	var segments [][]byte
-	err := rlp.NewStream(reader, uint64(maxDecompressedLen)).Decode(&segments)
+	if err := rlp.NewStream(reader, uint64(maxDecompressedLen)).Decode(&segments); err != nil {
+		return nil, &MalformedBatchError{Data: data, Err: err, fallback: header}
+	}
+	header.segments = segments
+	return header, nil
+}
+
+// parseSequencerMessageHeader decodes data's fixed L1 header and resolves
+// the codec and dictionary (if any) it names, returning the byte slice
+// following the header as payload. It understands both the legacy 40-byte
+// header and the extended 45-byte header carrying a codec id and dictionary
+// id (see afterDelayedMessagesExtendedFlag). header is always non-nil, even
+// on error, for the "treat the batch as empty" fallback policy.
+func parseSequencerMessageHeader(data []byte, dictionaries DictionaryProvider) (header *sequencerMessage, codec SegmentCodec, dict []byte, payload []byte, err error) {
+	if len(data) < legacySequencerMessageHeaderLen {
+		return &sequencerMessage{}, nil, nil, nil, errors.New("sequencer message missing L1 header")
+	}
+	rawAfterDelayedMessages := binary.BigEndian.Uint64(data[32:40])
+	header = &sequencerMessage{
+		minTimestamp: binary.BigEndian.Uint64(data[:8]),
+		maxTimestamp: binary.BigEndian.Uint64(data[8:16]),
+		minL1Block:   binary.BigEndian.Uint64(data[16:24]),
+		maxL1Block:   binary.BigEndian.Uint64(data[24:32]),
+	}
+	if rawAfterDelayedMessages&afterDelayedMessagesExtendedFlag == 0 {
+		header.afterDelayedMessages = rawAfterDelayedMessages
+		return header, codecsByID[BrotliCodecID], nil, data[legacySequencerMessageHeaderLen:], nil
+	}
+	header.afterDelayedMessages = rawAfterDelayedMessages &^ afterDelayedMessagesExtendedFlag
+	if len(data) < sequencerMessageHeaderLen {
+		return header, nil, nil, nil, errors.New("sequencer message missing extended L1 header")
+	}
+	dictionaryID := binary.BigEndian.Uint32(data[41:45])
+	codec, dict, err = resolveCodecAndDictionary(data[40], dictionaryID, dictionaries)
+	if err != nil {
+		return header, nil, nil, nil, err
+	}
+	return header, codec, dict, data[sequencerMessageHeaderLen:], nil
+}
+
+// resolveCodecAndDictionary looks up the codec named by codecID, and, if
+// dictionaryID is non-zero, resolves the matching dictionary and confirms
+// the codec actually supports one. It never panics: a bad codec id, a
+// dictionary id nobody can resolve, or a codec/dictionary mismatch all
+// come back as a plain error for the caller to report.
+func resolveCodecAndDictionary(codecID uint8, dictionaryID uint32, dictionaries DictionaryProvider) (SegmentCodec, []byte, error) {
+	codec, err := codecByID(codecID)
 	if err != nil {
-		fmt.Printf("Error parsing sequencer message segments: %s\n", err.Error())
-		segments = nil
+		return nil, nil, err
+	}
+	if dictionaryID == 0 {
+		return codec, nil, nil
 	}
-	return &sequencerMessage{
-		minTimestamp:         minTimestamp,
-		maxTimestamp:         maxTimestamp,
-		minL1Block:           minL1Block,
-		maxL1Block:           maxL1Block,
-		afterDelayedMessages: afterDelayedMessages,
-		segments:             segments,
+	if dictionaries == nil {
+		return nil, nil, fmt.Errorf("sequencer message names dictionary %v but no DictionaryProvider is configured", dictionaryID)
 	}
+	dictCodec, ok := codec.(DictionaryCodec)
+	if !ok {
+		return nil, nil, fmt.Errorf("codec %v does not support dictionaries", codecID)
+	}
+	dict, err := dictionaries.GetDictionary(dictionaryID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dictCodec, dict, nil
 }
 
+// Encode reproduces the pre-codec-dispatch wire format exactly: a legacy
+// 40-byte header with no codec tag, followed directly by a brotli stream.
+// Kept as the default so callers that don't care about codec choice see no
+// format change; use EncodeSmallest or EncodeWithDictionary to opt into the
+// extended header.
 func (m sequencerMessage) Encode() []byte {
-	var header [40]byte
+	var header [legacySequencerMessageHeaderLen]byte
 	binary.BigEndian.PutUint64(header[:8], m.minTimestamp)
 	binary.BigEndian.PutUint64(header[8:16], m.maxTimestamp)
 	binary.BigEndian.PutUint64(header[16:24], m.minL1Block)
 	binary.BigEndian.PutUint64(header[24:32], m.maxL1Block)
 	binary.BigEndian.PutUint64(header[32:40], m.afterDelayedMessages)
+	// brotliCodec writing to an in-memory bytes.Buffer with no dictionary
+	// can't fail, so a compress error here would mean a bug in brotliCodec
+	// itself, not bad input -- a panic is appropriate.
+	compressed, err := m.compress(brotliCodec{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return append(header[:], compressed...)
+}
+
+// EncodeSmallest tries every registered codec and returns the smallest
+// resulting message, tagged with the codec that produced it, so a batch
+// poster can save L1 calldata gas without hard-coding a codec choice. The
+// result always uses the extended header, since it must carry a codec tag.
+// Like Encode, it never errors in practice: every codecID it tries comes
+// from the registry itself and none are seeded with a dictionary.
+func (m sequencerMessage) EncodeSmallest() []byte {
+	var best []byte
+	for _, codecID := range knownCodecIDs {
+		encoded, err := m.encodeExtended(codecID, 0, nil)
+		if err != nil {
+			panic(err)
+		}
+		if best == nil || len(encoded) < len(best) {
+			best = encoded
+		}
+	}
+	return best
+}
+
+// EncodeWithDictionary encodes m using codecID seeded with dict, and tags
+// the header with dictionaryID so a reader can look the same dictionary up
+// again on the way back down. The result always uses the extended header.
+// Unlike Encode and EncodeSmallest, codecID and dict here may come from
+// outside this process (e.g. a dictionary loaded from disk or an L1
+// contract), so errors are returned rather than panicked on.
+func (m sequencerMessage) EncodeWithDictionary(codecID uint8, dictionaryID uint32, dict []byte) ([]byte, error) {
+	return m.encodeExtended(codecID, dictionaryID, dict)
+}
+
+func (m sequencerMessage) encodeExtended(codecID uint8, dictionaryID uint32, dict []byte) ([]byte, error) {
+	codec, err := codecByID(codecID)
+	if err != nil {
+		return nil, err
+	}
+	var header [sequencerMessageHeaderLen]byte
+	binary.BigEndian.PutUint64(header[:8], m.minTimestamp)
+	binary.BigEndian.PutUint64(header[8:16], m.maxTimestamp)
+	binary.BigEndian.PutUint64(header[16:24], m.minL1Block)
+	binary.BigEndian.PutUint64(header[24:32], m.maxL1Block)
+	binary.BigEndian.PutUint64(header[32:40], m.afterDelayedMessages|afterDelayedMessagesExtendedFlag)
+	header[40] = codecID
+	binary.BigEndian.PutUint32(header[41:45], dictionaryID)
+	compressed, err := m.compress(codec, dict)
+	if err != nil {
+		return nil, err
+	}
+	return append(header[:], compressed...), nil
+}
+
+// compress RLP-encodes m.segments and writes it through codec, seeded with
+// dict if non-empty. Close must run and its error must be checked before
+// buf.Bytes() is read, since some codecs (zstd in particular) flush their
+// frame terminator on Close. Errors from the codec -- including a dict
+// that fails to parse as the codec's own dictionary format -- are returned
+// rather than panicked on, since dict may come from outside this process.
+func (m sequencerMessage) compress(codec SegmentCodec, dict []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	segmentsEnc, err := rlp.EncodeToBytes(&m.segments)
 	if err != nil {
 		panic("couldn't encode sequencerMessage")
 	}
 
-	writer := brotli.NewWriter(buf)
-	defer writer.Close()
-	_, err = writer.Write(segmentsEnc)
-	if err != nil {
-		panic("Could not write")
+	var writer io.WriteCloser
+	if len(dict) == 0 {
+		writer = codec.NewWriter(buf)
+	} else {
+		dictCodec, ok := codec.(DictionaryCodec)
+		if !ok {
+			return nil, fmt.Errorf("codec does not support dictionaries")
+		}
+		writer = dictCodec.NewWriterWithDictionary(buf, dict)
+	}
+	if _, err := writer.Write(segmentsEnc); err != nil {
+		return nil, fmt.Errorf("writing compressed sequencer message: %w", err)
+	}
+	if flusher, ok := writer.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
 	}
-	writer.Flush()
-	return append(header[:], buf.Bytes()...)
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("closing codec writer: %w", err)
+	}
+	return buf.Bytes(), nil
 }
 
 type AdvanceAction uint8
@@ -113,6 +301,21 @@ const (
 	AdvanceMessage
 )
 
+// MalformedBatchPolicy controls what an inboxMultiplexer does when a
+// sequencer batch fails to parse.
+type MalformedBatchPolicy uint8
+
+const (
+	// SkipMalformedBatch treats an unparsable batch as empty and skips the
+	// delayed-message range it claimed to cover, per spec, rather than
+	// failing the whole inbox over one bad batch.
+	SkipMalformedBatch MalformedBatchPolicy = iota
+	// FailOnMalformedBatch propagates MalformedBatchError to the caller
+	// instead of recovering, for callers that would rather halt than
+	// silently skip inbox content.
+	FailOnMalformedBatch
+)
+
 type inboxMultiplexer struct {
 	backend                       InboxBackend
 	delayedMessagesRead           uint64
@@ -120,15 +323,42 @@ type inboxMultiplexer struct {
 	advanceSegmentTo              uint64
 	sequencerMessageCache         *sequencerMessage
 	sequencerMessageCachePosition uint64
+	dictionaries                  DictionaryProvider
+	malformedBatchPolicy          MalformedBatchPolicy
+	logger                        log.Logger
+}
+
+// InboxMultiplexerOption configures optional, rarely-changed settings on an
+// inboxMultiplexer, as opposed to the parameters every caller must supply.
+type InboxMultiplexerOption func(*inboxMultiplexer)
+
+// WithLogger routes the multiplexer's malformed-batch warnings to logger
+// instead of the default root logger, so callers can fold them into their
+// own logging pipeline.
+func WithLogger(logger log.Logger) InboxMultiplexerOption {
+	return func(m *inboxMultiplexer) {
+		m.logger = logger
+	}
 }
 
-func NewInboxMultiplexer(backend InboxBackend, delayedMessagesRead uint64) InboxMultiplexer {
-	return &inboxMultiplexer{
-		backend:             backend,
-		delayedMessagesRead: delayedMessagesRead,
-		advanceAction:       AdvanceUnknown,
-		advanceSegmentTo:    0,
+// NewInboxMultiplexer builds a multiplexer over backend. dictionaries may
+// be nil, in which case sequencer messages that name a non-zero dictionary
+// id fail to parse instead of silently decoding without one. policy
+// decides what happens when a batch fails to parse.
+func NewInboxMultiplexer(backend InboxBackend, delayedMessagesRead uint64, dictionaries DictionaryProvider, policy MalformedBatchPolicy, opts ...InboxMultiplexerOption) InboxMultiplexer {
+	m := &inboxMultiplexer{
+		backend:              backend,
+		delayedMessagesRead:  delayedMessagesRead,
+		advanceAction:        AdvanceUnknown,
+		advanceSegmentTo:     0,
+		dictionaries:         dictionaries,
+		malformedBatchPolicy: policy,
+		logger:               log.Root(),
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 var SequencerAddress = common.HexToAddress("0xA4B000000000000000000073657175656e636572") // TODO
@@ -138,15 +368,103 @@ const segmentKindDelayedMessages uint8 = 1
 const segmentKindAdvanceTimestamp uint8 = 2
 const segmentKindAdvanceL1BlockNumber uint8 = 3
 
-func (r *inboxMultiplexer) Peek() (*MessageWithMetadata, error) {
-	seqMsgPosition := r.backend.GetSequencerInboxPosition()
-	var seqMsg *sequencerMessage
-	if r.sequencerMessageCache != nil && r.sequencerMessageCachePosition == seqMsgPosition {
-		seqMsg = r.sequencerMessageCache
-	} else {
-		seqMsg = parseSequencerMessage(r.backend.PeekSequencerInbox())
-		r.sequencerMessageCache = seqMsg
+// buildL2Message turns a segmentKindL2Message segment into the message the
+// rest of the node expects, regardless of whether it came from the
+// random-access inboxMultiplexer or the segment-at-a-time
+// StreamingInboxMultiplexer.
+func buildL2Message(seqMsgPosition, segmentNum, delayedMessagesRead, timestamp, blockNumber uint64, segment []byte, mustEndBlock bool) *MessageWithMetadata {
+	var blockNumberHash common.Hash
+	copy(blockNumberHash[:], math.U256Bytes(new(big.Int).SetUint64(blockNumber)))
+	var timestampHash common.Hash
+	copy(blockNumberHash[:], math.U256Bytes(new(big.Int).SetUint64(timestamp)))
+	var requestId common.Hash
+	// TODO: a consistent request id. Right now we just don't set the request id when it isn't needed.
+	if len(segment) < 2 || segment[1] != arbos.L2MessageKind_SignedTx {
+		requestId[0] = 1 << 6
+		binary.BigEndian.PutUint64(requestId[(32-16):(32-8)], seqMsgPosition)
+		binary.BigEndian.PutUint64(requestId[(32-8):], segmentNum)
+	}
+	return &MessageWithMetadata{
+		Message: &arbos.L1IncomingMessage{
+			Header: &arbos.L1IncomingMessageHeader{
+				Kind:        arbos.L1MessageType_L2Message,
+				Sender:      SequencerAddress,
+				BlockNumber: blockNumberHash,
+				Timestamp:   timestampHash,
+				RequestId:   requestId,
+				GasPriceL1:  common.Hash{},
+			},
+			L2msg: segment[1:],
+		},
+		MustEndBlock:        mustEndBlock,
+		DelayedMessagesRead: delayedMessagesRead,
+	}
+}
+
+// decodeAdvancingValue decodes the RLP-encoded uint that follows the kind
+// byte in an advance-timestamp or advance-L1-block-number segment.
+func decodeAdvancingValue(data []byte) (uint64, error) {
+	return rlp.NewStream(bytes.NewReader(data), 16).Uint()
+}
+
+// clampToRange clamps value to [min, max], as sequencer messages' timestamp
+// and L1 block number accumulators must be within the header's bounds.
+func clampToRange(value, min, max uint64) uint64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// currentSequencerMessage returns the sequencer message at the backend's
+// current position, resolving it from cache or parsing it fresh. A message
+// left with nothing to yield -- no segments and no delayed messages still
+// to drain -- is skipped here, advancing to the next sequencer message so
+// an unreadable batch can't stall the inbox forever.
+func (r *inboxMultiplexer) currentSequencerMessage() (*sequencerMessage, uint64, error) {
+	for {
+		seqMsgPosition := r.backend.GetSequencerInboxPosition()
+		if r.sequencerMessageCache != nil && r.sequencerMessageCachePosition == seqMsgPosition {
+			return r.sequencerMessageCache, seqMsgPosition, nil
+		}
+		data := r.backend.PeekSequencerInbox()
+		if len(data) == 0 {
+			// Nothing posted at this position at all, as opposed to a
+			// non-empty but unparsable batch: the reader has caught up to
+			// the tip of the inbox, not found something malformed. Report
+			// it distinctly so the caller retries later instead of this
+			// being mistaken for (and skipped like) a malformed batch.
+			return nil, 0, ErrNoSequencerMessage
+		}
+		parsed, err := parseSequencerMessage(data, r.dictionaries)
+		if err != nil {
+			var malformed *MalformedBatchError
+			if errors.As(err, &malformed) {
+				malformed.Position = seqMsgPosition
+			}
+			if !errors.As(err, &malformed) || r.malformedBatchPolicy != SkipMalformedBatch || malformed.fallback == nil {
+				return nil, 0, err
+			}
+			r.logger.Warn("skipping malformed sequencer batch", "position", seqMsgPosition, "err", malformed.Err)
+			parsed = malformed.fallback
+		}
+		if len(parsed.segments) == 0 && r.delayedMessagesRead >= parsed.afterDelayedMessages {
+			r.backend.AdvanceSequencerInbox()
+			continue
+		}
+		r.sequencerMessageCache = parsed
 		r.sequencerMessageCachePosition = seqMsgPosition
+		return parsed, seqMsgPosition, nil
+	}
+}
+
+func (r *inboxMultiplexer) Peek() (*MessageWithMetadata, error) {
+	seqMsg, seqMsgPosition, err := r.currentSequencerMessage()
+	if err != nil {
+		return nil, err
 	}
 	segmentNum := r.backend.GetPositionWithinMessage()
 	var timestamp uint64
@@ -162,10 +480,10 @@ func (r *inboxMultiplexer) Peek() (*MessageWithMetadata, error) {
 		}
 		segmentKind := segment[0]
 		if segmentKind == segmentKindAdvanceTimestamp || segmentKind == segmentKindAdvanceL1BlockNumber {
-			rd := bytes.NewReader(segment[1:])
-			advancing, err := rlp.NewStream(rd, 16).Uint()
+			advancing, err := decodeAdvancingValue(segment[1:])
 			if err != nil {
-				fmt.Printf("Error parsing advancing segment: %s\n", err)
+				r.logger.Warn("failed to parse advancing segment", "position", seqMsgPosition, "segment", segmentNum, "err", err)
+				segmentNum++
 				continue
 			}
 			if segmentKind == segmentKindAdvanceTimestamp {
@@ -178,16 +496,8 @@ func (r *inboxMultiplexer) Peek() (*MessageWithMetadata, error) {
 			break
 		}
 	}
-	if timestamp < seqMsg.minTimestamp {
-		timestamp = seqMsg.minTimestamp
-	} else if timestamp > seqMsg.maxTimestamp {
-		timestamp = seqMsg.maxTimestamp
-	}
-	if blockNumber < seqMsg.minL1Block {
-		blockNumber = seqMsg.minL1Block
-	} else if blockNumber > seqMsg.maxL1Block {
-		blockNumber = seqMsg.maxL1Block
-	}
+	timestamp = clampToRange(timestamp, seqMsg.minTimestamp, seqMsg.maxTimestamp)
+	blockNumber = clampToRange(blockNumber, seqMsg.minL1Block, seqMsg.maxL1Block)
 	if segmentNum >= uint64(len(seqMsg.segments)) {
 		if r.delayedMessagesRead < seqMsg.afterDelayedMessages {
 			data := r.backend.ReadDelayedInbox(r.delayedMessagesRead)
@@ -207,51 +517,38 @@ func (r *inboxMultiplexer) Peek() (*MessageWithMetadata, error) {
 		r.advanceAction = AdvanceMessage
 		return nil, fmt.Errorf("reading end of sequencer message (size %v)", len(seqMsg.segments))
 	}
-	endOfMessage := segmentNum+1 >= uint64(len(seqMsg.segments))
-	if endOfMessage {
-		r.advanceAction = AdvanceMessage
-	} else {
-		r.advanceAction = AdvanceSegment
-		r.advanceSegmentTo = segmentNum + 1
-	}
+	lastSegment := segmentNum+1 >= uint64(len(seqMsg.segments))
 	segment := seqMsg.segments[int(segmentNum)]
 	if len(segment) == 0 {
 		return nil, errors.New("empty sequencer message segment")
 	}
 	segmentKind := segment[0]
 	if segmentKind == segmentKindL2Message {
-		// L2 message
-		var blockNumberHash common.Hash
-		copy(blockNumberHash[:], math.U256Bytes(new(big.Int).SetUint64(blockNumber)))
-		var timestampHash common.Hash
-		copy(blockNumberHash[:], math.U256Bytes(new(big.Int).SetUint64(timestamp)))
-		var requestId common.Hash
-		// TODO: a consistent request id. Right now we just don't set the request id when it isn't needed.
-		if len(segment) < 2 || segment[1] != arbos.L2MessageKind_SignedTx {
-			requestId[0] = 1 << 6
-			binary.BigEndian.PutUint64(requestId[(32-16):(32-8)], r.backend.GetSequencerInboxPosition())
-			binary.BigEndian.PutUint64(requestId[(32-8):], segmentNum)
-		}
-		msg := &MessageWithMetadata{
-			Message: &arbos.L1IncomingMessage{
-				Header: &arbos.L1IncomingMessageHeader{
-					Kind:        arbos.L1MessageType_L2Message,
-					Sender:      SequencerAddress,
-					BlockNumber: blockNumberHash,
-					Timestamp:   timestampHash,
-					RequestId:   requestId,
-					GasPriceL1:  common.Hash{},
-				},
-				L2msg: segment[1:],
-			},
-			MustEndBlock:        endOfMessage,
-			DelayedMessagesRead: r.delayedMessagesRead,
+		// A sequencer message whose delayed-message count extends past its
+		// last segment (drained by the trailing branch above, on a later
+		// Peek call) isn't actually done once this L2 segment is returned,
+		// even if it's the last segment: jumping straight to the next
+		// message here would strand those delayed messages unread, and
+		// marking this message MustEndBlock would end the block before
+		// they're accounted for.
+		endOfMessage := lastSegment && r.delayedMessagesRead >= seqMsg.afterDelayedMessages
+		if endOfMessage {
+			r.advanceAction = AdvanceMessage
+		} else {
+			r.advanceAction = AdvanceSegment
+			r.advanceSegmentTo = segmentNum + 1
 		}
+		msg := buildL2Message(r.backend.GetSequencerInboxPosition(), segmentNum, r.delayedMessagesRead, timestamp, blockNumber, segment, endOfMessage)
 		return msg, nil
 	} else if segmentKind == segmentKindDelayedMessages {
+		if lastSegment {
+			r.advanceAction = AdvanceMessage
+		} else {
+			r.advanceAction = AdvanceSegment
+			r.advanceSegmentTo = segmentNum + 1
+		}
 		// Delayed message reading
-		rd := bytes.NewReader(segment[1:])
-		reading, err := rlp.NewStream(rd, 16).Uint()
+		reading, err := decodeAdvancingValue(segment[1:])
 		if err != nil {
 			return nil, err
 		}
@@ -302,4 +599,4 @@ func (r *inboxMultiplexer) Advance() {
 
 func (r *inboxMultiplexer) DelayedMessagesRead() uint64 {
 	return r.delayedMessagesRead
-}
\ No newline at end of file
+}
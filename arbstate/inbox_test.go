@@ -0,0 +1,232 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+package arbstate
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func encodeSegmentsForTest(segments [][]byte) ([]byte, error) {
+	return rlp.EncodeToBytes(&segments)
+}
+
+func testSegments() [][]byte {
+	return [][]byte{
+		{segmentKindL2Message, 0xAA, 0xBB},
+		{segmentKindAdvanceTimestamp, 0x05},
+		{segmentKindL2Message, 0xCC, 0xDD, 0xEE},
+	}
+}
+
+// TestParseSequencerMessageLegacyFixture decodes a batch built the same way
+// every batch posted before codec dispatch existed was: a 40-byte header
+// with no codec tag, immediately followed by a raw brotli stream, built
+// here without going through sequencerMessage.Encode so the fixture doesn't
+// depend on the code under test.
+func TestParseSequencerMessageLegacyFixture(t *testing.T) {
+	msg := sequencerMessage{
+		minTimestamp:         1,
+		maxTimestamp:         2,
+		minL1Block:           3,
+		maxL1Block:           4,
+		afterDelayedMessages: 5,
+		segments:             testSegments(),
+	}
+
+	var header [legacySequencerMessageHeaderLen]byte
+	putUint64 := func(offset int, v uint64) {
+		for i := 7; i >= 0; i-- {
+			header[offset+i] = byte(v)
+			v >>= 8
+		}
+	}
+	putUint64(0, msg.minTimestamp)
+	putUint64(8, msg.maxTimestamp)
+	putUint64(16, msg.minL1Block)
+	putUint64(24, msg.maxL1Block)
+	putUint64(32, msg.afterDelayedMessages)
+
+	segmentsEnc, err := encodeSegmentsForTest(msg.segments)
+	if err != nil {
+		t.Fatalf("encodeSegmentsForTest: %v", err)
+	}
+	var buf bytes.Buffer
+	writer := brotliCodec{}.NewWriter(&buf)
+	if _, err := writer.Write(segmentsEnc); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	data := append(header[:], buf.Bytes()...)
+
+	parsed, err := parseSequencerMessage(data, nil)
+	if err != nil {
+		t.Fatalf("parseSequencerMessage: %v", err)
+	}
+	if parsed.afterDelayedMessages != msg.afterDelayedMessages {
+		t.Fatalf("afterDelayedMessages = %v, want %v", parsed.afterDelayedMessages, msg.afterDelayedMessages)
+	}
+	if !reflect.DeepEqual(parsed.segments, msg.segments) {
+		t.Fatalf("segments = %v, want %v", parsed.segments, msg.segments)
+	}
+}
+
+// TestPeekAtEndOfInboxDoesNotLoop confirms Peek tells a backend with nothing
+// at all posted at the current position (the reader has caught up to the
+// tip of the inbox) apart from a malformed batch: under SkipMalformedBatch,
+// an empty peek must surface as ErrNoSequencerMessage without advancing,
+// not be treated as a batch to skip past, which would call
+// AdvanceSequencerInbox forever since the position never has anything
+// there.
+func TestPeekAtEndOfInboxDoesNotLoop(t *testing.T) {
+	backend := &fakeInboxBackend{}
+	m := NewInboxMultiplexer(backend, 0, nil, SkipMalformedBatch)
+	_, err := m.Peek()
+	if !errors.Is(err, ErrNoSequencerMessage) {
+		t.Fatalf("Peek() error = %v, want ErrNoSequencerMessage", err)
+	}
+	if backend.batchPos != 0 {
+		t.Fatalf("backend.batchPos = %v, want 0 (must not advance past a nonexistent batch)", backend.batchPos)
+	}
+}
+
+// TestEncodeRoundTripsLegacyFormat confirms sequencerMessage.Encode still
+// produces the legacy 40-byte-header format and that it parses back to the
+// original message.
+func TestEncodeRoundTripsLegacyFormat(t *testing.T) {
+	msg := sequencerMessage{
+		minTimestamp:         10,
+		maxTimestamp:         20,
+		minL1Block:           30,
+		maxL1Block:           40,
+		afterDelayedMessages: 50,
+		segments:             testSegments(),
+	}
+	data := msg.Encode()
+	if len(data) < legacySequencerMessageHeaderLen {
+		t.Fatalf("encoded message shorter than legacy header: %v bytes", len(data))
+	}
+
+	parsed, err := parseSequencerMessage(data, nil)
+	if err != nil {
+		t.Fatalf("parseSequencerMessage: %v", err)
+	}
+	if !reflect.DeepEqual(parsed.segments, msg.segments) {
+		t.Fatalf("segments = %v, want %v", parsed.segments, msg.segments)
+	}
+	if parsed.afterDelayedMessages != msg.afterDelayedMessages {
+		t.Fatalf("afterDelayedMessages = %v, want %v", parsed.afterDelayedMessages, msg.afterDelayedMessages)
+	}
+}
+
+// TestSkipMalformedBatchAdvancesPastUnreadableHeader confirms that a batch
+// too short to contain even the legacy header doesn't stall the
+// multiplexer under SkipMalformedBatch: since its header can't be read at
+// all, its fallback is treated as a wholly empty batch (no segments, no
+// delayed messages), which Peek must skip outright rather than handing
+// back an error the caller has no way to advance past.
+func TestSkipMalformedBatchAdvancesPastUnreadableHeader(t *testing.T) {
+	valid := sequencerMessage{
+		maxTimestamp: 1000,
+		maxL1Block:   1000,
+		segments:     [][]byte{encodedL2Segment(0xAA)},
+	}
+	backend := &fakeInboxBackend{batches: [][]byte{
+		{0x01, 0x02, 0x03}, // shorter than legacySequencerMessageHeaderLen
+		valid.Encode(),
+	}}
+
+	m := NewInboxMultiplexer(backend, 0, nil, SkipMalformedBatch)
+	msg, err := m.Peek()
+	if err != nil {
+		t.Fatalf("Peek() did not skip past the unreadable batch: %v", err)
+	}
+	if msg == nil || len(msg.Message.L2msg) == 0 || msg.Message.L2msg[0] != 0xAA {
+		t.Fatalf("Peek() returned %+v, want the valid batch's L2 message", msg)
+	}
+	if backend.batchPos != 1 {
+		t.Fatalf("backend.batchPos = %v, want 1 (the unreadable batch should have been advanced past)", backend.batchPos)
+	}
+}
+
+// TestFailOnMalformedBatchSetsPosition confirms that under
+// FailOnMalformedBatch, the *MalformedBatchError returned straight from
+// Peek (not recovered via the SkipMalformedBatch fallback) still has
+// Position filled in, not left at its zero value.
+func TestFailOnMalformedBatchSetsPosition(t *testing.T) {
+	backend := &fakeInboxBackend{batches: [][]byte{
+		nil,                // never read: the backend starts at position 1
+		{0x01, 0x02, 0x03}, // shorter than legacySequencerMessageHeaderLen
+	}, batchPos: 1}
+	m := NewInboxMultiplexer(backend, 0, nil, FailOnMalformedBatch)
+	_, err := m.Peek()
+	var malformed *MalformedBatchError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("Peek() error = %v, want a *MalformedBatchError", err)
+	}
+	if malformed.Position != 1 {
+		t.Fatalf("malformed.Position = %v, want 1", malformed.Position)
+	}
+}
+
+// TestPeekSkipsMalformedAdvanceSegment confirms a segment whose advancing
+// value fails to decode is skipped by incrementing segmentNum rather than
+// being re-read forever, and that the valid segment after it is still
+// returned.
+func TestPeekSkipsMalformedAdvanceSegment(t *testing.T) {
+	msg := sequencerMessage{
+		maxTimestamp: 1000,
+		maxL1Block:   1000,
+		segments: [][]byte{
+			{segmentKindAdvanceTimestamp, 0xc0}, // 0xc0 is an RLP list, not a uint
+			encodedL2Segment(0xAA),
+		},
+	}
+	backend := &fakeInboxBackend{batches: [][]byte{msg.Encode()}}
+	m := NewInboxMultiplexer(backend, 0, nil, SkipMalformedBatch)
+
+	peeked, err := m.Peek()
+	if err != nil {
+		t.Fatalf("Peek() = %v, want the segment past the malformed advance segment", err)
+	}
+	if peeked == nil || len(peeked.Message.L2msg) == 0 || peeked.Message.L2msg[0] != 0xAA {
+		t.Fatalf("Peek() = %+v, want the L2 segment after the malformed one", peeked)
+	}
+}
+
+// TestEncodeSmallestRoundTripsExtendedFormat confirms EncodeSmallest, which
+// must use the extended header to carry a codec tag, parses back correctly
+// regardless of which codec it picked.
+func TestEncodeSmallestRoundTripsExtendedFormat(t *testing.T) {
+	msg := sequencerMessage{
+		minTimestamp:         10,
+		maxTimestamp:         20,
+		minL1Block:           30,
+		maxL1Block:           40,
+		afterDelayedMessages: 50,
+		segments:             testSegments(),
+	}
+	data := msg.EncodeSmallest()
+	if len(data) < sequencerMessageHeaderLen {
+		t.Fatalf("encoded message shorter than extended header: %v bytes", len(data))
+	}
+
+	parsed, err := parseSequencerMessage(data, nil)
+	if err != nil {
+		t.Fatalf("parseSequencerMessage: %v", err)
+	}
+	if !reflect.DeepEqual(parsed.segments, msg.segments) {
+		t.Fatalf("segments = %v, want %v", parsed.segments, msg.segments)
+	}
+	if parsed.afterDelayedMessages != msg.afterDelayedMessages {
+		t.Fatalf("afterDelayedMessages = %v, want %v", parsed.afterDelayedMessages, msg.afterDelayedMessages)
+	}
+}
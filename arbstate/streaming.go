@@ -0,0 +1,332 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+package arbstate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/offchainlabs/arbstate/arbos"
+)
+
+// StreamingMessageIterator yields a batch's messages one at a time instead
+// of requiring them all to be parsed into memory up front.
+type StreamingMessageIterator interface {
+	// Next returns the next message, whether any further messages remain,
+	// and any error hit along the way. Once more is false or err is
+	// non-nil, the iterator is exhausted and should not be called again.
+	Next() (*MessageWithMetadata, bool, error)
+}
+
+// StreamingInboxMultiplexerOption configures optional settings on a
+// StreamingInboxMultiplexer.
+type StreamingInboxMultiplexerOption func(*StreamingInboxMultiplexer)
+
+// WithStreamingLogger routes a StreamingInboxMultiplexer's malformed-batch
+// warnings to logger instead of the default root logger.
+func WithStreamingLogger(logger log.Logger) StreamingInboxMultiplexerOption {
+	return func(m *StreamingInboxMultiplexer) {
+		m.logger = logger
+	}
+}
+
+// StreamingInboxMultiplexer is a memory-bounded alternative to
+// inboxMultiplexer that pulls one segment at a time out of the codec's
+// reader via rlp.NewStream instead of decoding a batch's whole segment list
+// up front. It cannot seek within a batch; callers that need random access
+// should use NewInboxMultiplexer instead.
+type StreamingInboxMultiplexer struct {
+	backend              InboxBackend
+	delayedMessagesRead  uint64
+	dictionaries         DictionaryProvider
+	malformedBatchPolicy MalformedBatchPolicy
+	logger               log.Logger
+
+	batch *streamingBatch
+}
+
+// NewStreamingInboxMultiplexer builds a streaming multiplexer over backend,
+// sharing the codec registry and DictionaryProvider plumbing with
+// NewInboxMultiplexer.
+func NewStreamingInboxMultiplexer(backend InboxBackend, delayedMessagesRead uint64, dictionaries DictionaryProvider, policy MalformedBatchPolicy, opts ...StreamingInboxMultiplexerOption) *StreamingInboxMultiplexer {
+	m := &StreamingInboxMultiplexer{
+		backend:              backend,
+		delayedMessagesRead:  delayedMessagesRead,
+		dictionaries:         dictionaries,
+		malformedBatchPolicy: policy,
+		logger:               log.Root(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (s *StreamingInboxMultiplexer) DelayedMessagesRead() uint64 {
+	return s.delayedMessagesRead
+}
+
+// streamingBatch tracks progress through the current sequencer message:
+// the rlp.Stream segments are pulled from one at a time, plus a one-segment
+// lookahead buffer so MustEndBlock can be set correctly without decoding
+// the whole segment list ahead of time.
+type streamingBatch struct {
+	position     uint64
+	header       *sequencerMessage
+	stream       *rlp.Stream
+	segmentNum   uint64
+	segmentsDone bool
+	pending      []byte
+	pendingSet   bool
+
+	// timestamp and blockNumber accumulate the advance segments
+	// contiguously preceding the segment about to be returned, mirroring
+	// inboxMultiplexer.Peek, and reset to 0 once an L2 message or
+	// delayed-messages segment is reached.
+	timestamp   uint64
+	blockNumber uint64
+
+	// pendingDelayedRemaining counts down the delayed messages a
+	// segmentKindDelayedMessages segment asked for, one per Next() call.
+	pendingDelayedRemaining uint64
+}
+
+// newSegmentStream parses a sequencer message's header and returns an
+// rlp.Stream positioned at the start of its segment list, without decoding
+// any segments yet. It shares parseSequencerMessageHeader with
+// parseSequencerMessage so a streamed batch and a randomly-accessed one
+// are parsed identically up to that point.
+func newSegmentStream(data []byte, dictionaries DictionaryProvider) (*rlp.Stream, *sequencerMessage, error) {
+	header, codec, dict, payload, err := parseSequencerMessageHeader(data, dictionaries)
+	if err != nil {
+		return nil, nil, &MalformedBatchError{Data: data, Err: err, fallback: header}
+	}
+	var reader io.Reader
+	if len(dict) == 0 {
+		reader = codec.NewReader(bytes.NewReader(payload))
+	} else {
+		reader = codec.(DictionaryCodec).NewReaderWithDictionary(bytes.NewReader(payload), dict)
+	}
+	stream := rlp.NewStream(io.LimitReader(reader, maxDecompressedLen), uint64(maxDecompressedLen))
+	if _, err := stream.List(); err != nil {
+		return nil, nil, &MalformedBatchError{Data: data, Err: err, fallback: header}
+	}
+	return stream, header, nil
+}
+
+// readSegment returns the next segment in the batch, consuming the
+// lookahead buffer first if one was filled by peekHasNext.
+func (b *streamingBatch) readSegment() ([]byte, bool, error) {
+	if b.pendingSet {
+		segment := b.pending
+		b.pending = nil
+		b.pendingSet = false
+		return segment, true, nil
+	}
+	if b.segmentsDone || b.stream == nil {
+		return nil, false, nil
+	}
+	var segment []byte
+	err := b.stream.Decode(&segment)
+	if err == rlp.EOL {
+		b.segmentsDone = true
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return segment, true, nil
+}
+
+// peekHasNext reports whether another segment follows the one just
+// returned, decoding it into a one-segment lookahead buffer if so. This is
+// the only bookkeeping this type needs beyond the current segment, which is
+// what keeps memory bounded.
+func (b *streamingBatch) peekHasNext() (bool, error) {
+	if b.pendingSet {
+		return true, nil
+	}
+	if b.segmentsDone || b.stream == nil {
+		return false, nil
+	}
+	var segment []byte
+	err := b.stream.Decode(&segment)
+	if err == rlp.EOL {
+		b.segmentsDone = true
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	b.pending = segment
+	b.pendingSet = true
+	return true, nil
+}
+
+// Next implements StreamingMessageIterator.
+func (s *StreamingInboxMultiplexer) Next() (*MessageWithMetadata, bool, error) {
+	for {
+		if s.batch == nil {
+			opened, err := s.openNextBatch()
+			if err != nil {
+				return nil, false, err
+			}
+			if !opened {
+				return nil, false, nil
+			}
+		}
+		msg, err := s.nextFromBatch()
+		if err != nil {
+			return nil, false, err
+		}
+		if msg != nil {
+			return msg, true, nil
+		}
+		// The current batch's segments and delayed messages are both
+		// exhausted; loop around to open the next one.
+	}
+}
+
+func (s *StreamingInboxMultiplexer) openNextBatch() (bool, error) {
+	position := s.backend.GetSequencerInboxPosition()
+	data := s.backend.PeekSequencerInbox()
+	if len(data) == 0 {
+		// Nothing posted at this position at all, as opposed to a
+		// non-empty but unparsable batch: the reader has caught up to the
+		// tip of the inbox. Report "no batch opened" rather than treating
+		// this like a malformed batch to skip past, which would advance
+		// the backend forever with nothing new ever appearing.
+		return false, nil
+	}
+	stream, header, err := newSegmentStream(data, s.dictionaries)
+	if err != nil {
+		var malformed *MalformedBatchError
+		if errors.As(err, &malformed) {
+			malformed.Position = position
+		}
+		if !errors.As(err, &malformed) || s.malformedBatchPolicy != SkipMalformedBatch || malformed.fallback == nil {
+			return false, err
+		}
+		s.logger.Warn("skipping malformed sequencer batch", "position", position, "err", malformed.Err)
+		header, stream = malformed.fallback, nil
+	}
+	s.batch = &streamingBatch{position: position, header: header, stream: stream, segmentsDone: stream == nil}
+	return true, nil
+}
+
+// nextFromBatch returns the next message out of the current batch, or nil
+// once it has none left (having already advanced the backend past it).
+func (s *StreamingInboxMultiplexer) nextFromBatch() (*MessageWithMetadata, error) {
+	b := s.batch
+	for {
+		if b.pendingDelayedRemaining > 0 {
+			data := s.backend.ReadDelayedInbox(s.delayedMessagesRead)
+			delayed, err := arbos.ParseIncomingL1Message(bytes.NewReader(data))
+			s.delayedMessagesRead++
+			b.pendingDelayedRemaining--
+			endOfBatch := b.pendingDelayedRemaining == 0 && s.delayedMessagesRead >= b.header.afterDelayedMessages
+			if endOfBatch {
+				// Segments may still follow this delayed-messages segment;
+				// the batch only ends once none do.
+				hasNext, peekErr := b.peekHasNext()
+				if peekErr != nil {
+					return nil, peekErr
+				}
+				endOfBatch = !hasNext
+			}
+			if endOfBatch {
+				s.advanceBatch()
+			}
+			return &MessageWithMetadata{
+				Message:             delayed,
+				MustEndBlock:        b.pendingDelayedRemaining == 0,
+				DelayedMessagesRead: s.delayedMessagesRead,
+			}, err
+		}
+		segment, ok, err := b.readSegment()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		segmentNum := b.segmentNum
+		b.segmentNum++
+		if len(segment) == 0 {
+			continue
+		}
+		switch segment[0] {
+		case segmentKindAdvanceTimestamp, segmentKindAdvanceL1BlockNumber:
+			advancing, err := decodeAdvancingValue(segment[1:])
+			if err != nil {
+				s.logger.Warn("failed to parse advancing segment", "position", b.position, "segment", segmentNum, "err", err)
+				continue
+			}
+			if segment[0] == segmentKindAdvanceTimestamp {
+				b.timestamp += advancing
+			} else {
+				b.blockNumber += advancing
+			}
+		case segmentKindL2Message:
+			hasNext, err := b.peekHasNext()
+			if err != nil {
+				return nil, err
+			}
+			timestamp := clampToRange(b.timestamp, b.header.minTimestamp, b.header.maxTimestamp)
+			blockNumber := clampToRange(b.blockNumber, b.header.minL1Block, b.header.maxL1Block)
+			b.timestamp = 0
+			b.blockNumber = 0
+			// A trailing delayed-message count past the last segment (drained
+			// below, on a later Next call) means this L2 message isn't
+			// actually the end of the block yet, even though no more
+			// segments follow it: matches inboxMultiplexer.Peek, which for
+			// the same reason defers MustEndBlock to whichever delayed
+			// message is actually last.
+			mustEndBlock := !hasNext && s.delayedMessagesRead >= b.header.afterDelayedMessages
+			return buildL2Message(b.position, segmentNum, s.delayedMessagesRead, timestamp, blockNumber, segment, mustEndBlock), nil
+		case segmentKindDelayedMessages:
+			reading, err := decodeAdvancingValue(segment[1:])
+			if err != nil {
+				return nil, err
+			}
+			newRead := s.delayedMessagesRead + reading
+			if newRead <= s.delayedMessagesRead || newRead > b.header.afterDelayedMessages {
+				return nil, errors.New("bad delayed message reading count")
+			}
+			b.pendingDelayedRemaining = reading
+			b.timestamp = 0
+			b.blockNumber = 0
+			continue
+		default:
+			return nil, fmt.Errorf("bad sequencer message segment kind %v", segment[0])
+		}
+	}
+
+	if s.delayedMessagesRead < b.header.afterDelayedMessages {
+		data := s.backend.ReadDelayedInbox(s.delayedMessagesRead)
+		delayed, err := arbos.ParseIncomingL1Message(bytes.NewReader(data))
+		s.delayedMessagesRead++
+		endOfBatch := s.delayedMessagesRead >= b.header.afterDelayedMessages
+		if endOfBatch {
+			s.advanceBatch()
+		}
+		return &MessageWithMetadata{
+			Message:             delayed,
+			MustEndBlock:        endOfBatch,
+			DelayedMessagesRead: s.delayedMessagesRead,
+		}, err
+	}
+	s.advanceBatch()
+	return nil, nil
+}
+
+func (s *StreamingInboxMultiplexer) advanceBatch() {
+	s.backend.AdvanceSequencerInbox()
+	s.batch = nil
+}
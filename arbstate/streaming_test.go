@@ -0,0 +1,364 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+package arbstate
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// fakeInboxBackend is the minimal InboxBackend a multiplexer needs to read a
+// fixed sequence of already-encoded sequencer batches. It holds no delayed
+// inbox: ReadDelayedInbox returns nil for every sequence number, so the
+// tests below that read delayed messages all read the same empty data.
+type fakeInboxBackend struct {
+	batches   [][]byte
+	batchPos  uint64
+	withinPos uint64
+}
+
+func (b *fakeInboxBackend) PeekSequencerInbox() []byte {
+	if b.batchPos >= uint64(len(b.batches)) {
+		return nil
+	}
+	return b.batches[b.batchPos]
+}
+
+func (b *fakeInboxBackend) GetSequencerInboxPosition() uint64 { return b.batchPos }
+
+func (b *fakeInboxBackend) AdvanceSequencerInbox() {
+	b.batchPos++
+	b.withinPos = 0
+}
+
+func (b *fakeInboxBackend) GetPositionWithinMessage() uint64    { return b.withinPos }
+func (b *fakeInboxBackend) SetPositionWithinMessage(pos uint64) { b.withinPos = pos }
+func (b *fakeInboxBackend) ReadDelayedInbox(uint64) []byte      { return nil }
+
+func encodedAdvanceSegment(kind uint8, value uint64) []byte {
+	enc, err := rlp.EncodeToBytes(value)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{kind}, enc...)
+}
+
+func encodedL2Segment(payload byte) []byte {
+	return []byte{segmentKindL2Message, payload}
+}
+
+func encodedDelayedMessagesSegment(reading uint64) []byte {
+	return encodedAdvanceSegment(segmentKindDelayedMessages, reading)
+}
+
+// replayBothMultiplexers runs iterations Peek/Advance calls against a fresh
+// inboxMultiplexer and the same number of Next calls against a fresh
+// StreamingInboxMultiplexer, both reading data, and returns what each
+// produced so a test can compare them.
+func replayBothMultiplexers(t *testing.T, data []byte, iterations int) (randomAccessMsgs, streamingMsgs []*MessageWithMetadata) {
+	t.Helper()
+
+	randomAccess := NewInboxMultiplexer(&fakeInboxBackend{batches: [][]byte{data}}, 0, nil, FailOnMalformedBatch)
+	for i := 0; i < iterations; i++ {
+		m, err := randomAccess.Peek()
+		if err != nil {
+			t.Fatalf("Peek() iteration %d: %v", i, err)
+		}
+		randomAccess.Advance()
+		randomAccessMsgs = append(randomAccessMsgs, m)
+	}
+
+	streaming := NewStreamingInboxMultiplexer(&fakeInboxBackend{batches: [][]byte{data}}, 0, nil, FailOnMalformedBatch)
+	for i := 0; i < iterations; i++ {
+		m, more, err := streaming.Next()
+		if err != nil {
+			t.Fatalf("Next() iteration %d: %v", i, err)
+		}
+		if !more {
+			t.Fatalf("Next() iteration %d: expected more messages", i)
+		}
+		streamingMsgs = append(streamingMsgs, m)
+	}
+	return randomAccessMsgs, streamingMsgs
+}
+
+// TestStreamingMatchesRandomAccessTimestamps replays the batch
+// [L2, adv(+5), L2, adv(+3), L2] through both inboxMultiplexer and
+// StreamingInboxMultiplexer and checks they agree message-for-message,
+// including on the timestamp/block-number accounting: each L2 message's
+// timestamp and block number only reflect advance segments contiguous with
+// it, not a running sum across the whole batch.
+func TestStreamingMatchesRandomAccessTimestamps(t *testing.T) {
+	msg := sequencerMessage{
+		minTimestamp:         0,
+		maxTimestamp:         1000,
+		minL1Block:           0,
+		maxL1Block:           1000,
+		afterDelayedMessages: 0,
+		segments: [][]byte{
+			encodedL2Segment(0xAA),
+			encodedAdvanceSegment(segmentKindAdvanceTimestamp, 5),
+			encodedL2Segment(0xBB),
+			encodedAdvanceSegment(segmentKindAdvanceTimestamp, 3),
+			encodedL2Segment(0xCC),
+		},
+	}
+	data := msg.Encode()
+
+	gotRandomAccess, gotStreaming := replayBothMultiplexers(t, data, 3)
+	if !reflect.DeepEqual(gotRandomAccess, gotStreaming) {
+		t.Fatalf("streaming and random-access multiplexers disagree:\nrandom-access: %+v\nstreaming:     %+v", gotRandomAccess, gotStreaming)
+	}
+}
+
+// TestStreamingMatchesRandomAccessTrailingDelayedMessages replays a batch
+// whose last segment is an L2 message but whose afterDelayedMessages still
+// has messages owed past it (no explicit segmentKindDelayedMessages segment
+// covers them), and checks both multiplexers agree that the L2 message does
+// NOT end the block and that the two delayed messages that follow it do --
+// exactly one of them, the last -- rather than either multiplexer dropping
+// the delayed messages or marking more than one message MustEndBlock.
+func TestStreamingMatchesRandomAccessTrailingDelayedMessages(t *testing.T) {
+	msg := sequencerMessage{
+		maxTimestamp:         1000,
+		maxL1Block:           1000,
+		afterDelayedMessages: 2,
+		segments: [][]byte{
+			encodedL2Segment(0xAA),
+		},
+	}
+	data := msg.Encode()
+
+	gotRandomAccess, gotStreaming := replayBothMultiplexers(t, data, 3)
+	if !reflect.DeepEqual(gotRandomAccess, gotStreaming) {
+		t.Fatalf("streaming and random-access multiplexers disagree:\nrandom-access: %+v\nstreaming:     %+v", gotRandomAccess, gotStreaming)
+	}
+	for i, m := range gotRandomAccess[:2] {
+		if m.MustEndBlock {
+			t.Fatalf("message %d unexpectedly set MustEndBlock", i)
+		}
+	}
+	if !gotRandomAccess[2].MustEndBlock {
+		t.Fatalf("final delayed message did not set MustEndBlock")
+	}
+}
+
+// TestStreamingMatchesRandomAccessDelayedMessageSegment replays a batch
+// ending in an explicit segmentKindDelayedMessages segment and checks both
+// multiplexers agree.
+func TestStreamingMatchesRandomAccessDelayedMessageSegment(t *testing.T) {
+	msg := sequencerMessage{
+		maxTimestamp:         1000,
+		maxL1Block:           1000,
+		afterDelayedMessages: 1,
+		segments: [][]byte{
+			encodedL2Segment(0xAA),
+			encodedDelayedMessagesSegment(1),
+		},
+	}
+	data := msg.Encode()
+
+	gotRandomAccess, gotStreaming := replayBothMultiplexers(t, data, 2)
+	if !reflect.DeepEqual(gotRandomAccess, gotStreaming) {
+		t.Fatalf("streaming and random-access multiplexers disagree:\nrandom-access: %+v\nstreaming:     %+v", gotRandomAccess, gotStreaming)
+	}
+	if gotRandomAccess[0].MustEndBlock {
+		t.Fatalf("L2 message unexpectedly set MustEndBlock")
+	}
+	if !gotRandomAccess[1].MustEndBlock {
+		t.Fatalf("delayed message did not set MustEndBlock")
+	}
+}
+
+// TestNextAdvancesPastBatchEndingInDelayedMessagesSegment confirms that
+// once a segmentKindDelayedMessages segment's last delayed message is
+// delivered and it fully satisfies afterDelayedMessages, Next advances the
+// backend to the next batch rather than re-entering an exhausted segment
+// stream on the following call.
+func TestNextAdvancesPastBatchEndingInDelayedMessagesSegment(t *testing.T) {
+	batch1 := sequencerMessage{
+		maxTimestamp:         1000,
+		maxL1Block:           1000,
+		afterDelayedMessages: 1,
+		segments: [][]byte{
+			encodedL2Segment(0xAA),
+			encodedDelayedMessagesSegment(1),
+		},
+	}
+	batch2 := sequencerMessage{
+		maxTimestamp: 1000,
+		maxL1Block:   1000,
+		segments:     [][]byte{encodedL2Segment(0xBB)},
+	}
+	backend := &fakeInboxBackend{batches: [][]byte{batch1.Encode(), batch2.Encode()}}
+	m := NewStreamingInboxMultiplexer(backend, 0, nil, FailOnMalformedBatch)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := m.Next(); err != nil {
+			t.Fatalf("Next() iteration %d: %v", i, err)
+		}
+	}
+	if backend.batchPos != 1 {
+		t.Fatalf("backend.batchPos = %v, want 1 (batch 1 should have been advanced past)", backend.batchPos)
+	}
+
+	got, more, err := m.Next()
+	if err != nil {
+		t.Fatalf("Next() did not deliver batch 2: %v", err)
+	}
+	if !more || got == nil || len(got.Message.L2msg) == 0 || got.Message.L2msg[0] != 0xBB {
+		t.Fatalf("Next() = %+v, more=%v, want batch 2's L2 message", got, more)
+	}
+}
+
+// TestNextAtEndOfInboxDoesNotLoop confirms Next tells a backend with
+// nothing at all posted at the current position apart from a malformed
+// batch: under SkipMalformedBatch, an empty peek must surface as "no more
+// messages" without advancing, not be treated as a batch to skip past,
+// which would call AdvanceSequencerInbox forever.
+func TestNextAtEndOfInboxDoesNotLoop(t *testing.T) {
+	backend := &fakeInboxBackend{}
+	m := NewStreamingInboxMultiplexer(backend, 0, nil, SkipMalformedBatch)
+	msg, more, err := m.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v, want nil", err)
+	}
+	if more {
+		t.Fatalf("Next() more = true, want false at end of inbox")
+	}
+	if msg != nil {
+		t.Fatalf("Next() msg = %+v, want nil", msg)
+	}
+	if backend.batchPos != 0 {
+		t.Fatalf("backend.batchPos = %v, want 0 (must not advance past a nonexistent batch)", backend.batchPos)
+	}
+}
+
+// TestNextFailOnMalformedBatchSetsPosition confirms that under
+// FailOnMalformedBatch, the *MalformedBatchError returned straight from
+// Next has Position filled in, not left at its zero value.
+func TestNextFailOnMalformedBatchSetsPosition(t *testing.T) {
+	backend := &fakeInboxBackend{batches: [][]byte{
+		nil,                // never read: the backend starts at position 1
+		{0x01, 0x02, 0x03}, // shorter than legacySequencerMessageHeaderLen
+	}, batchPos: 1}
+	m := NewStreamingInboxMultiplexer(backend, 0, nil, FailOnMalformedBatch)
+	_, _, err := m.Next()
+	var malformed *MalformedBatchError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("Next() error = %v, want a *MalformedBatchError", err)
+	}
+	if malformed.Position != 1 {
+		t.Fatalf("malformed.Position = %v, want 1", malformed.Position)
+	}
+}
+
+// TestNextSkipsMalformedAdvanceSegment confirms a segment whose advancing
+// value fails to decode is skipped by advancing b.segmentNum rather than
+// being re-read forever, and that the valid segment after it is still
+// returned.
+func TestNextSkipsMalformedAdvanceSegment(t *testing.T) {
+	msg := sequencerMessage{
+		maxTimestamp: 1000,
+		maxL1Block:   1000,
+		segments: [][]byte{
+			{segmentKindAdvanceTimestamp, 0xc0}, // 0xc0 is an RLP list, not a uint
+			encodedL2Segment(0xAA),
+		},
+	}
+	backend := &fakeInboxBackend{batches: [][]byte{msg.Encode()}}
+	m := NewStreamingInboxMultiplexer(backend, 0, nil, SkipMalformedBatch)
+
+	got, more, err := m.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v, want the segment past the malformed advance segment", err)
+	}
+	if !more || got == nil || len(got.Message.L2msg) == 0 || got.Message.L2msg[0] != 0xAA {
+		t.Fatalf("Next() = %+v, more=%v, want the L2 segment after the malformed one", got, more)
+	}
+}
+
+// tinySegmentBatch builds a synthetic batch of n single-L2-message segments,
+// the shape StreamingInboxMultiplexer exists to handle without holding the
+// whole decoded segment list in memory at once.
+func tinySegmentBatch(n int) ([]byte, int) {
+	segments := make([][]byte, n)
+	for i := range segments {
+		segments[i] = []byte{segmentKindL2Message, byte(i), byte(i >> 8)}
+	}
+	msg := sequencerMessage{
+		maxTimestamp: ^uint64(0),
+		maxL1Block:   ^uint64(0),
+		segments:     segments,
+	}
+	return msg.Encode(), n
+}
+
+// benchmarkPeakHeap runs a single traversal of n items b.N times via step,
+// reporting allocs/op (via b.ReportAllocs) and the largest HeapInuse
+// observed as a peak-heap-bytes metric. Unlike sampling between iterations
+// -- which only ever sees memory after the traversal's reader has already
+// gone out of scope and its batch been released -- this samples partway
+// through a single in-flight traversal, while the random-access reader's
+// fully-decoded segment list (or the streaming reader's one-segment
+// lookahead) is actually still live, so it can tell "holds the whole batch"
+// apart from "holds one segment" at the 10k-segment scale. It's still a
+// stand-in for peak RSS, which Go's testing package has no portable way to
+// measure directly, but one sample taken while memory is actually held
+// beats sampling only after it's been freed.
+func benchmarkPeakHeap(b *testing.B, n int, step func(i int)) {
+	b.ReportAllocs()
+	var peak uint64
+	var stats runtime.MemStats
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < n; j++ {
+			step(j)
+			if j == n/2 {
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peak {
+					peak = stats.HeapInuse
+				}
+			}
+		}
+	}
+	b.ReportMetric(float64(peak), "peak-heap-bytes")
+}
+
+// BenchmarkStreamingMemory measures StreamingInboxMultiplexer reading a
+// synthetic 10k-tiny-segment batch start to finish.
+func BenchmarkStreamingMemory(b *testing.B) {
+	data, n := tinySegmentBatch(10000)
+	var m *StreamingInboxMultiplexer
+	benchmarkPeakHeap(b, n, func(i int) {
+		if i == 0 {
+			m = NewStreamingInboxMultiplexer(&fakeInboxBackend{batches: [][]byte{data}}, 0, nil, FailOnMalformedBatch)
+		}
+		if _, _, err := m.Next(); err != nil {
+			b.Fatalf("Next: %v", err)
+		}
+	})
+}
+
+// BenchmarkRandomAccessMemory measures inboxMultiplexer reading the same
+// synthetic 10k-tiny-segment batch, for comparison against
+// BenchmarkStreamingMemory.
+func BenchmarkRandomAccessMemory(b *testing.B) {
+	data, n := tinySegmentBatch(10000)
+	var m InboxMultiplexer
+	benchmarkPeakHeap(b, n, func(i int) {
+		if i == 0 {
+			m = NewInboxMultiplexer(&fakeInboxBackend{batches: [][]byte{data}}, 0, nil, FailOnMalformedBatch)
+		}
+		if _, err := m.Peek(); err != nil {
+			b.Fatalf("Peek: %v", err)
+		}
+		m.Advance()
+	})
+}
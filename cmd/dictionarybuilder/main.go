@@ -0,0 +1,96 @@
+//
+// Copyright 2021, Offchain Labs, Inc. All rights reserved.
+//
+
+// dictionarybuilder trains a zstd dictionary from a corpus of recently
+// posted sequencer batches and writes it to disk under a name derived from
+// its keccak256. Deriving the id this way means a node replaying batches
+// from L1 data alone can look the dictionary back up without a side
+// channel telling it which one was used.
+//
+// klauspost/compress/zstd's WithEncoderDict/WithDecoderDicts (used by
+// zstdCodec.New*WithDictionary) require a dictionary in zstd's own trained
+// format -- a magic number followed by entropy tables -- not arbitrary
+// corpus bytes, and klauspost/compress doesn't implement the trainer
+// itself. This shells out to the reference zstd CLI's --train mode, which
+// does.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/offchainlabs/arbstate/arbstate"
+)
+
+func main() {
+	corpusDir := flag.String("corpus", "", "directory of raw batch payloads to train on")
+	outDir := flag.String("out", ".", "directory to write the trained dictionary to")
+	dictSize := flag.Int("size", 16*1024, "target dictionary size in bytes")
+	flag.Parse()
+
+	if *corpusDir == "" {
+		log.Fatal("-corpus is required")
+	}
+
+	samplePaths, err := corpusFilePaths(*corpusDir)
+	if err != nil {
+		log.Fatalf("failed to read corpus: %v", err)
+	}
+	if len(samplePaths) == 0 {
+		log.Fatal("corpus directory contained no samples")
+	}
+
+	dict, err := trainDictionary(samplePaths, *dictSize)
+	if err != nil {
+		log.Fatalf("failed to train dictionary: %v", err)
+	}
+
+	id := arbstate.DictionaryID(dict)
+	outPath := filepath.Join(*outDir, fmt.Sprintf("dictionary-%08x.zdict", id))
+	if err := ioutil.WriteFile(outPath, dict, 0644); err != nil {
+		log.Fatalf("failed to write dictionary: %v", err)
+	}
+	fmt.Printf("wrote %d byte dictionary %08x to %s\n", len(dict), id, outPath)
+}
+
+// trainDictionary runs the zstd CLI's --train mode over samplePaths,
+// producing a dictionary of at most maxSize bytes in zstd's trained
+// format, and returns its contents.
+func trainDictionary(samplePaths []string, maxSize int) ([]byte, error) {
+	tmpDict, err := ioutil.TempFile("", "dictionarybuilder-*.zdict")
+	if err != nil {
+		return nil, err
+	}
+	tmpDict.Close()
+
+	args := append([]string{"--train"}, samplePaths...)
+	args = append(args, "-o", tmpDict.Name(), fmt.Sprintf("--maxdict=%d", maxSize))
+	cmd := exec.Command("zstd", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("zstd --train: %w: %s", err, out)
+	}
+
+	return ioutil.ReadFile(tmpDict.Name())
+}
+
+// corpusFilePaths lists the regular files directly under dir, for passing
+// to zstd --train as the sample set.
+func corpusFilePaths(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	return paths, nil
+}